@@ -0,0 +1,416 @@
+// Copyright 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	context "golang.org/x/net/context"
+
+	"github.com/gorilla/websocket"
+)
+
+// stdStream identifies which of the container's stdio streams a framed
+// attach message belongs to, following the same single header byte
+// Docker's multiplexed attach stream uses. It is only meaningful for
+// non-terminal attaches; a terminal attach carries one unframed byte
+// stream, exactly like `docker attach` to a tty container.
+type stdStream byte
+
+const (
+	stdin  stdStream = 0
+	stdout stdStream = 1
+	stderr stdStream = 2
+
+	// stdExit is not one of Docker's stream ids; the -subreaper exec
+	// socket protocol reuses the same framing for its own stdio and
+	// overloads this id for the one non-stdio message it needs, the
+	// process's final exit code, so everything for one exec can share a
+	// single connection without an ambiguous second message format.
+	stdExit stdStream = 3
+)
+
+// defaultDetachKeys is the default client detach sequence, ctrl-p,ctrl-q,
+// matching Docker's default so existing attach clients need no changes.
+const defaultDetachKeys = "ctrl-p,ctrl-q"
+
+// attachOutboxSize bounds how many not-yet-written chunks we'll queue
+// for a single slow attach client before dropping new ones, so one
+// stuck client can never stall delivery to every other attached client.
+const attachOutboxSize = 256
+
+// attachHub fans the container's stdout/stderr out to every attached
+// client and multiplexes every attached client's stdin back into the
+// container, without tearing the container down when a client
+// disconnects. It sits alongside shim.proxyStdio, which still owns the
+// shim's own os.Stdin/Stdout/Stderr.
+type attachHub struct {
+	mu          sync.Mutex
+	subscribers map[*attachConn]struct{}
+
+	stdin    io.Writer
+	terminal bool
+
+	detachKeys []byte
+}
+
+func newAttachHub(stdinWriter io.Writer, detachKeys string, terminal bool) (*attachHub, error) {
+	keys, err := parseDetachKeys(detachKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &attachHub{
+		subscribers: make(map[*attachConn]struct{}),
+		stdin:       stdinWriter,
+		terminal:    terminal,
+		detachKeys:  keys,
+	}, nil
+}
+
+// broadcast is fed by the copy goroutines shim.proxyStdio already runs
+// for the container's stdout/stderr. It frames the chunk once (skipping
+// framing entirely for a terminal attach, which carries one raw byte
+// stream same as `docker attach` to a tty container) and hands it to
+// each subscriber's own outbox, never blocking on a client's socket
+// itself so one slow or stuck client can't stall delivery to the rest.
+func (h *attachHub) broadcast(stream stdStream, p []byte) {
+	msg := p
+	if !h.terminal {
+		msg = frame(stream, p)
+	}
+	// Copy since p's backing array belongs to the caller's read buffer
+	// and will be reused before every subscriber's outbox drains it.
+	buf := append([]byte(nil), msg...)
+
+	h.mu.Lock()
+	conns := make([]*attachConn, 0, len(h.subscribers))
+	for c := range h.subscribers {
+		conns = append(conns, c)
+	}
+	h.mu.Unlock()
+
+	for _, c := range conns {
+		c.enqueue(buf)
+	}
+}
+
+func (h *attachHub) attach(c *attachConn) {
+	h.mu.Lock()
+	h.subscribers[c] = struct{}{}
+	h.mu.Unlock()
+}
+
+func (h *attachHub) detach(c *attachConn) {
+	h.mu.Lock()
+	delete(h.subscribers, c)
+	h.mu.Unlock()
+	c.Close()
+}
+
+// attachConn is one attached client's connection, hijacked HTTP or
+// WebSocket, normalized to the same raw read/write interface. Writes
+// are queued on outbox and flushed by a dedicated pump goroutine so a
+// client that stops reading never blocks attachHub.broadcast. closed
+// guards outbox itself: enqueue and stop race with each other (enqueue
+// runs on whichever goroutine is delivering a broadcast, stop runs when
+// the client's own serve loop exits), and closing a channel a pending
+// send is about to use panics the whole shim, not just this client.
+type attachConn struct {
+	io.Closer
+	rawWrite func([]byte) error
+	read     func([]byte) (int, error)
+
+	outbox chan []byte
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newAttachConn(closer io.Closer, rawWrite func([]byte) error, read func([]byte) (int, error)) *attachConn {
+	c := &attachConn{
+		Closer:   closer,
+		rawWrite: rawWrite,
+		read:     read,
+		outbox:   make(chan []byte, attachOutboxSize),
+	}
+	go c.pump()
+	return c
+}
+
+// pump is the only goroutine that ever calls rawWrite for this client,
+// so a blocked write just backs up this client's own outbox instead of
+// anything shared across clients.
+func (c *attachConn) pump() {
+	for p := range c.outbox {
+		if err := c.rawWrite(p); err != nil {
+			return
+		}
+	}
+}
+
+// enqueue hands the next chunk to this client's outbox without ever
+// blocking the caller: if the client is too far behind to keep up, the
+// chunk is dropped rather than stalling the broadcaster. Guarded by the
+// same mutex as stop so a broadcast in flight during teardown never
+// sends on an outbox that's already been closed.
+func (c *attachConn) enqueue(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+
+	select {
+	case c.outbox <- p:
+	default:
+		logger().Warn("attach client backpressure, dropping chunk")
+	}
+}
+
+func (c *attachConn) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.outbox)
+}
+
+// attachServer is the HTTP server exposed when -attach-addr is set. It
+// supports both a hijacked raw connection (like docker attach) and a
+// WebSocket upgrade, both carrying the same stream format (framed, or
+// raw for a terminal attach).
+type attachServer struct {
+	hub      *attachHub
+	upgrader websocket.Upgrader
+}
+
+func newAttachServer(hub *attachHub) *attachServer {
+	return &attachServer{
+		hub: hub,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+func (s *attachServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		s.serveWS(w, r)
+		return
+	}
+	s.serveHijack(w, r)
+}
+
+func (s *attachServer) serveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger().WithError(err).Error("failed to upgrade attach websocket")
+		return
+	}
+
+	c := newAttachConn(conn,
+		func(p []byte) error {
+			return conn.WriteMessage(websocket.BinaryMessage, p)
+		},
+		func(p []byte) (int, error) {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return 0, err
+			}
+			return copy(p, data), nil
+		},
+	)
+
+	s.serve(c)
+}
+
+func (s *attachServer) serveHijack(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection does not support hijacking", http.StatusInternalServerError)
+		return
+	}
+
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		logger().WithError(err).Error("failed to hijack attach connection")
+		return
+	}
+
+	io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+
+	c := newAttachConn(conn,
+		func(p []byte) error {
+			_, err := conn.Write(p)
+			return err
+		},
+		bufrw.Read,
+	)
+
+	s.serve(c)
+}
+
+// serve pumps the client's stdin into the container and the container's
+// stdout/stderr out to the client until the client disconnects or sends
+// the detach key sequence, at which point the container keeps running.
+func (s *attachServer) serve(c *attachConn) {
+	s.hub.attach(c)
+	// Detach before stop: once c is out of h.subscribers no new
+	// broadcast will enqueue to it, so it's then safe to close its
+	// outbox. Deferred in this order so detach runs first (defers
+	// unwind LIFO).
+	defer c.stop()
+	defer s.hub.detach(c)
+
+	detector := newDetachDetector(s.hub.detachKeys)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := c.read(buf)
+		if err != nil {
+			return
+		}
+		chunk, detached := detector.feed(buf[:n])
+		if len(chunk) > 0 && s.hub.stdin != nil {
+			if _, err := s.hub.stdin.Write(chunk); err != nil {
+				return
+			}
+		}
+		if detached {
+			return
+		}
+	}
+}
+
+func frame(stream stdStream, p []byte) []byte {
+	header := make([]byte, 8)
+	header[0] = byte(stream)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+	return append(header, p...)
+}
+
+// readFrame reads one Docker-style multiplexed frame from r: an 8-byte
+// header (stream id, 3 bytes unused, 4-byte big-endian payload length)
+// followed by the payload.
+func readFrame(r io.Reader) (stdStream, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[4:])
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return stdStream(header[0]), payload, nil
+}
+
+// listenAndServeAttach starts the attach HTTP server on addr and serves
+// it in the background for the lifetime of the shim process.
+func listenAndServeAttach(addr string, hub *attachHub) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: newAttachServer(hub)}
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logger().WithError(err).Error("attach server exited")
+		}
+	}()
+
+	return nil
+}
+
+// attachStdio splices the shim's own os.Stdin/Stdout/Stderr through a
+// tee: every byte shim.proxyStdio writes to stdout/stderr (and reads
+// from stdin) is counted and timestamped by a per-stream streamStats,
+// and, if addr is set, also fanned out to/merged with an HTTP/WebSocket
+// attach hub. It returns a func that restores the original
+// os.Stdin/Stdout/Stderr once proxyStdio is done with them.
+func attachStdio(ctx context.Context, container, execID, addr, detachKeys string, terminal bool, stallTimeout time.Duration) (restore func(), err error) {
+	realStdin, realStdout, realStderr := os.Stdin, os.Stdout, os.Stderr
+
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	var hub *attachHub
+	if addr != "" {
+		hub, err = newAttachHub(stdinW, detachKeys, terminal)
+		if err != nil {
+			return nil, err
+		}
+		if err := listenAndServeAttach(addr, hub); err != nil {
+			return nil, err
+		}
+	}
+
+	stats := []*streamStats{
+		newStreamStats(stdin, container, execID),
+		newStreamStats(stdout, container, execID),
+		newStreamStats(stderr, container, execID),
+	}
+	go watchStreams(ctx, stats, stallTimeout)
+
+	go copyCounting(stdinW, realStdin, stats[0])
+	go teeToHub(stdoutR, realStdout, hub, stdout, stats[1])
+	go teeToHub(stderrR, realStderr, hub, stderr, stats[2])
+
+	os.Stdin, os.Stdout, os.Stderr = stdinR, stdoutW, stderrW
+
+	return func() {
+		os.Stdin, os.Stdout, os.Stderr = realStdin, realStdout, realStderr
+		stdoutW.Close()
+		stderrW.Close()
+		stdinW.Close()
+	}, nil
+}
+
+// teeToHub copies from r to dst (the shim's real stdout/stderr),
+// recording every chunk in stats and, if hub is non-nil, fanning it out
+// to every attached client framed with which stream it came from.
+func teeToHub(r io.Reader, dst io.Writer, hub *attachHub, stream stdStream, stats *streamStats) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			stats.record(n)
+			if dst != nil {
+				dst.Write(buf[:n])
+			}
+			if hub != nil {
+				hub.broadcast(stream, buf[:n])
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				stats.recordErr(err)
+			}
+			return
+		}
+	}
+}
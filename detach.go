@@ -0,0 +1,89 @@
+// Copyright 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseDetachKeys turns a comma-separated key sequence such as
+// "ctrl-p,ctrl-q" into the raw bytes that sequence produces on a
+// terminal, the same syntax and default as Docker's --detach-keys.
+func parseDetachKeys(s string) ([]byte, error) {
+	if s == "" {
+		s = defaultDetachKeys
+	}
+
+	var keys []byte
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		switch {
+		case strings.HasPrefix(k, "ctrl-") && len(k) == 6:
+			b := k[5]
+			switch {
+			case b >= 'a' && b <= 'z':
+				keys = append(keys, b-'a'+1)
+			case b == '@':
+				keys = append(keys, 0)
+			case b == '^':
+				keys = append(keys, 30)
+			case b == '_':
+				keys = append(keys, 31)
+			default:
+				return nil, fmt.Errorf("invalid detach key %q", k)
+			}
+		case len(k) == 1:
+			keys = append(keys, k[0])
+		default:
+			return nil, fmt.Errorf("invalid detach key %q", k)
+		}
+	}
+	return keys, nil
+}
+
+// detachDetector scans an attached client's incoming stdin for the
+// configured detach key sequence without blocking that byte from being
+// forwarded until the whole sequence (or a non-matching byte) is seen.
+type detachDetector struct {
+	keys    []byte
+	matched int
+}
+
+func newDetachDetector(keys []byte) *detachDetector {
+	return &detachDetector{keys: keys}
+}
+
+// feed processes the next chunk of client input, returning the bytes
+// that should still be forwarded to the container's stdin (with any
+// partial or full detach sequence stripped out) and whether the full
+// sequence was just completed.
+func (d *detachDetector) feed(p []byte) (forward []byte, detached bool) {
+	if len(d.keys) == 0 {
+		return p, false
+	}
+
+	forward = make([]byte, 0, len(p))
+	for _, b := range p {
+		if b == d.keys[d.matched] {
+			d.matched++
+			if d.matched == len(d.keys) {
+				return forward, true
+			}
+			continue
+		}
+		if d.matched > 0 {
+			forward = append(forward, d.keys[:d.matched]...)
+			d.matched = 0
+		}
+		if b == d.keys[0] {
+			d.matched = 1
+			continue
+		}
+		forward = append(forward, b)
+	}
+	return forward, false
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	context "golang.org/x/net/context"
+)
+
+// copyCounting is io.Copy with its byte counts and errors recorded in
+// stats, used for the legs of the stdio pipe that don't also need to be
+// fanned out to attach clients (the shim's own stdin read).
+func copyCounting(dst io.Writer, src io.Reader, stats *streamStats) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			stats.record(n)
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				stats.recordErr(werr)
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				stats.recordErr(err)
+			}
+			return
+		}
+	}
+}
+
+// streamStats tracks cumulative bytes copied and the last time any
+// bytes flowed for one of a process's stdio streams, so hangs on close
+// or a missing EOF from the agent show up in the logs instead of just
+// looking like the shim went quiet.
+type streamStats struct {
+	name      string
+	log       *logrus.Entry
+	bytes     int64
+	lastBytes int64
+	lastAt    int64 // unix nanoseconds, accessed atomically
+	errs      int64
+}
+
+func newStreamStats(stream stdStream, container, execID string) *streamStats {
+	name := map[stdStream]string{stdin: "stdin", stdout: "stdout", stderr: "stderr"}[stream]
+	return &streamStats{
+		name: name,
+		log: logger().WithFields(logrus.Fields{
+			"stream":    name,
+			"container": container,
+			"exec-id":   execID,
+		}),
+		lastAt: time.Now().UnixNano(),
+	}
+}
+
+func (s *streamStats) record(n int) {
+	if n > 0 {
+		atomic.AddInt64(&s.bytes, int64(n))
+		atomic.StoreInt64(&s.lastAt, time.Now().UnixNano())
+	}
+}
+
+func (s *streamStats) recordErr(err error) {
+	atomic.AddInt64(&s.errs, 1)
+	s.log.WithError(err).Warn("stream copy error")
+}
+
+func (s *streamStats) lastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastAt))
+}
+
+// watchStreams periodically logs each stream's cumulative byte count
+// and, if stallTimeout is positive, emits a warn-level event the first
+// time a stream goes that long without any bytes copied on it. Each
+// stream is judged on its own: an idle stream warns even while bytes
+// flow on the others, and no check is made across all streams together.
+// It runs until ctx is done.
+func watchStreams(ctx context.Context, stats []*streamStats, stallTimeout time.Duration) {
+	interval := stallTimeout
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	stalled := make(map[*streamStats]bool)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, s := range stats {
+				total := atomic.LoadInt64(&s.bytes)
+				last := atomic.LoadInt64(&s.lastBytes)
+				atomic.StoreInt64(&s.lastBytes, total)
+
+				s.log.WithFields(logrus.Fields{
+					"bytes-copied":  total,
+					"last-activity": s.lastActivity(),
+				}).Debug("stream copy progress")
+
+				if stallTimeout <= 0 {
+					continue
+				}
+
+				idle := time.Since(s.lastActivity())
+				if total == last && idle >= stallTimeout {
+					if !stalled[s] {
+						s.log.WithFields(logrus.Fields{
+							"idle":          idle.String(),
+							"bytes-copied":  total,
+							"last-activity": s.lastActivity(),
+						}).Warn("no bytes copied on stream for longer than io-stall-timeout")
+						stalled[s] = true
+					}
+				} else {
+					stalled[s] = false
+				}
+			}
+		}
+	}
+}
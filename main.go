@@ -21,6 +21,8 @@ import (
 	"github.com/sirupsen/logrus"
 	lSyslog "github.com/sirupsen/logrus/hooks/syslog"
 	context "golang.org/x/net/context"
+
+	"github.com/bergwolf/shim/shimv2"
 )
 
 const (
@@ -97,15 +99,98 @@ func setThreads() {
 	}
 }
 
+// isShimV2 reports whether we were invoked the way containerd invokes a
+// runtime v2 shim binary, i.e. with a "start" or "delete" verb as the
+// last argument rather than the one-shot proxy mode's plain flag list.
+func isShimV2() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+	switch os.Args[len(os.Args)-1] {
+	case "start", "delete":
+		return true
+	default:
+		return false
+	}
+}
+
+// shimV2Main runs kata-shim as a containerd-shim-v2 TTRPC task service
+// instead of the one-shot proxy mode in realMain. containerd starts one
+// such shim per sandbox and drives every Create/Start/Exec/Kill/Wait/
+// ResizePty/CloseIO/Delete call for that sandbox's processes over the
+// socket printed on stdout here.
+func shimV2Main(ctx context.Context) (exitCode int) {
+	var (
+		id            string
+		bundle        string
+		namespace     string
+		address       string
+		publishBinary string
+	)
+
+	flag.StringVar(&id, "id", "", "sandbox id")
+	flag.StringVar(&bundle, "bundle", "", "OCI bundle path")
+	flag.StringVar(&namespace, "namespace", "", "containerd namespace")
+	flag.StringVar(&address, "address", "", "containerd socket address")
+	flag.StringVar(&publishBinary, "publish-binary", "containerd", "binary used to publish task events back to containerd")
+	flag.StringVar(&agentAddrV2, "agent", "", "agent gRPC socket endpoint")
+	flag.Parse()
+
+	verb := flag.Arg(flag.NArg() - 1)
+
+	if err := initLogger("info", id, "", logrus.Fields{"mode": "shimv2", "verb": verb}, ioutil.Discard); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	switch verb {
+	case "delete":
+		if err := shimv2.Delete(ctx, id); err != nil {
+			logger().WithError(err).Error("failed to delete shim")
+			return exitFailure
+		}
+		return exitSuccess
+	case "start":
+		socket, err := shimv2.Start(ctx, shimv2.Config{
+			ID:            id,
+			Bundle:        bundle,
+			Namespace:     namespace,
+			Address:       address,
+			PublishBinary: publishBinary,
+			AgentAddr:     agentAddrV2,
+		})
+		if err != nil {
+			logger().WithError(err).Error("failed to start shim v2 service")
+			return exitFailure
+		}
+		fmt.Println(socket)
+		return exitSuccess
+	default:
+		logger().WithField("verb", verb).Error("unknown shim v2 verb")
+		return exitFailure
+	}
+}
+
+// agentAddrV2 is parsed by shimV2Main; kept as a package variable rather
+// than a realMain local since the two modes parse disjoint flag sets.
+var agentAddrV2 string
+
 func realMain(ctx context.Context) (exitCode int) {
 	var (
-		logLevel      string
-		agentAddr     string
-		container     string
-		execID        string
-		terminal      bool
-		proxyExitCode bool
-		showVersion   bool
+		logLevel         string
+		agentAddr        string
+		container        string
+		execID           string
+		terminal         bool
+		proxyExitCode    bool
+		showVersion      bool
+		attachAddr       string
+		detachKeys       string
+		stateDir         string
+		reconnectTimeout time.Duration
+		subreaper        bool
+		execSocket       string
+		ioStallTimeout   time.Duration
 	)
 
 	setThreads()
@@ -120,6 +205,13 @@ func realMain(ctx context.Context) (exitCode int) {
 	flag.StringVar(&execID, "exec-id", "", "process id for the shim")
 	flag.BoolVar(&terminal, "terminal", false, "specify if a terminal is setup")
 	flag.BoolVar(&proxyExitCode, "proxy-exit-code", true, "proxy exit code of the process")
+	flag.StringVar(&attachAddr, "attach-addr", "", "if set, expose the container's stdio for attach over HTTP/WebSocket on this address")
+	flag.StringVar(&detachKeys, "detach-keys", defaultDetachKeys, "key sequence an attached client sends to detach without stopping the container")
+	flag.StringVar(&stateDir, "state-dir", "", "directory to persist last known process state for recovery across agent reconnects")
+	flag.DurationVar(&reconnectTimeout, "agent-reconnect-timeout", 30*time.Second, "how long to keep retrying the agent connection before giving up")
+	flag.BoolVar(&subreaper, "subreaper", false, "become a child subreaper and accept further exec requests over -exec-socket; the shim exits once the first process and the execs it accepted are done")
+	flag.StringVar(&execSocket, "exec-socket", "", "Unix socket to accept additional exec requests on when -subreaper is set")
+	flag.DurationVar(&ioStallTimeout, "io-stall-timeout", 0, "warn if no bytes flow on stdin/stdout/stderr for this long (0 disables the stall watchdog)")
 
 	flag.Parse()
 
@@ -176,6 +268,23 @@ func realMain(ctx context.Context) (exitCode int) {
 		return exitFailure
 	}
 
+	var subreaperMgr *subreaperManager
+	if subreaper {
+		if err := becomeSubreaper(ctx); err != nil {
+			logger().WithError(err).Error("failed to become a child subreaper")
+			return exitFailure
+		}
+		if execSocket != "" {
+			subreaperMgr = newSubreaperManager(agentAddr, container)
+			go func() {
+				if err := subreaperMgr.serve(ctx, execSocket); err != nil {
+					logger().WithError(err).Error("exec socket server exited")
+				}
+			}()
+			defer subreaperMgr.wait()
+		}
+	}
+
 	// winsize
 	if terminal {
 		termios, err := setupTerminal(int(os.Stdin.Fd()))
@@ -205,6 +314,15 @@ func realMain(ctx context.Context) (exitCode int) {
 	// Add a tag to allow the I/O to be filtered out.
 	stdioSpan.SetTag("category", "interactive")
 
+	if attachAddr != "" || ioStallTimeout > 0 {
+		restoreStdio, err := attachStdio(ctx, container, execID, attachAddr, detachKeys, terminal, ioStallTimeout)
+		if err != nil {
+			logger().WithError(err).Error("failed to start attach/io-diagnostics server")
+			return exitFailure
+		}
+		defer restoreStdio()
+	}
+
 	shim.proxyStdio(wg, terminal)
 
 	wg.Wait()
@@ -212,7 +330,8 @@ func realMain(ctx context.Context) (exitCode int) {
 	stdioSpan.Finish()
 
 	// wait until exit
-	exitcode, err := shim.wait()
+	waiter := newReconnectingWaiter(shim, agentAddr, container, execID, stateDir, reconnectTimeout)
+	exitcode, err := waiter.wait(ctx)
 	if err != nil {
 		logger().WithError(err).WithField("exec-id", execID).Error("failed waiting for process")
 		return exitFailure
@@ -232,7 +351,12 @@ func main() {
 
 	defer handlePanic(ctx)
 
-	exitCode := realMain(ctx)
+	var exitCode int
+	if isShimV2() {
+		exitCode = shimV2Main(ctx)
+	} else {
+		exitCode = realMain(ctx)
+	}
 
 	stopTracing(ctx)
 
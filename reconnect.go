@@ -0,0 +1,244 @@
+// Copyright 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	aClient "github.com/kata-containers/agent/pkg/client"
+	pb "github.com/kata-containers/agent/protocols/grpc"
+	"github.com/sirupsen/logrus"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// processState is the last known status of the process a shim is
+// watching, persisted under -state-dir so that if the agent connection
+// dies and is later re-established, the shim can still report the
+// correct exit code instead of failing the whole wait.
+type processState struct {
+	Container string    `json:"container"`
+	ExecID    string    `json:"exec-id"`
+	Pid       uint32    `json:"pid"`
+	ExitCode  int32     `json:"exit-code"`
+	Exited    bool      `json:"exited"`
+	ExitedAt  time.Time `json:"exited-at,omitempty"`
+}
+
+func stateFilePath(stateDir, container, execID string) string {
+	return filepath.Join(stateDir, container+"-"+execID+".json")
+}
+
+func saveProcessState(stateDir string, s processState) error {
+	if stateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp := stateFilePath(stateDir, s.Container, s.ExecID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, stateFilePath(stateDir, s.Container, s.ExecID))
+}
+
+func loadProcessState(stateDir, container, execID string) (processState, bool) {
+	var s processState
+	if stateDir == "" {
+		return s, false
+	}
+
+	data, err := ioutil.ReadFile(stateFilePath(stateDir, container, execID))
+	if err != nil {
+		return s, false
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, false
+	}
+	return s, true
+}
+
+func removeProcessState(stateDir, container, execID string) {
+	if stateDir == "" {
+		return
+	}
+	os.Remove(stateFilePath(stateDir, container, execID))
+}
+
+// reconnectingWaiter wraps shim.wait() with a reconnect loop: if the
+// agent connection is lost while we're waiting on the process, it
+// redials the agent with exponential backoff and re-queries the
+// process's status instead of giving up and returning exitFailure,
+// which otherwise loses the exit code and hangs anything (like
+// `docker stop`) waiting on it.
+type reconnectingWaiter struct {
+	shim             *shim
+	agentAddr        string
+	container        string
+	execID           string
+	stateDir         string
+	reconnectTimeout time.Duration
+}
+
+func newReconnectingWaiter(s *shim, agentAddr, container, execID, stateDir string, reconnectTimeout time.Duration) *reconnectingWaiter {
+	return &reconnectingWaiter{
+		shim:             s,
+		agentAddr:        agentAddr,
+		container:        container,
+		execID:           execID,
+		stateDir:         stateDir,
+		reconnectTimeout: reconnectTimeout,
+	}
+}
+
+// wait behaves like shim.wait() on the happy path, but on a lost agent
+// connection retries the dial with exponential backoff (capped at
+// reconnectTimeout) and re-issues WaitProcess against the freshly
+// dialed connection, which the agent answers immediately with the exit
+// code if the process already exited while we were disconnected, or
+// blocks until it does otherwise. If we give up reconnecting, we fall
+// back to any last-known exit code persisted under -state-dir.
+func (w *reconnectingWaiter) wait(ctx context.Context) (int32, error) {
+	exitCode, err := w.shim.wait()
+	if err == nil {
+		w.persist(exitCode, true)
+		return exitCode, nil
+	}
+
+	if !isConnectionError(err) {
+		return 0, err
+	}
+
+	log := logger().WithFields(logrus.Fields{
+		"container": w.container,
+		"exec-id":   w.execID,
+	})
+	log.WithError(err).Warn("agent connection lost while waiting for process, reconnecting")
+
+	// We have nothing of our own yet, but a previous invocation of this
+	// same shim (e.g. one that crashed right after learning the exit
+	// code but before its caller acted on it) may already have
+	// persisted it. Check now rather than only after every retry is
+	// exhausted, so a stale-but-good record doesn't sit unread for the
+	// entire reconnectTimeout.
+	if s, ok := loadProcessState(w.stateDir, w.container, w.execID); ok && s.Exited {
+		log.WithField("exitcode", s.ExitCode).Warn("found exit code persisted by a previous run, reporting it")
+		return s.ExitCode, nil
+	}
+
+	backoff := time.Second
+	deadline := time.Now().Add(w.reconnectTimeout)
+
+	for attempt := 1; time.Now().Before(deadline); attempt++ {
+		log.WithFields(logrus.Fields{
+			"attempt": attempt,
+			"backoff": backoff.String(),
+		}).Info("retrying agent connection")
+
+		exitCode, werr := w.reconnectAndWait(ctx)
+		if werr == nil {
+			log.WithField("exitcode", exitCode).Info("recovered exit code after reconnect")
+			w.persist(exitCode, true)
+			return exitCode, nil
+		}
+
+		if !isConnectionError(werr) {
+			return 0, werr
+		}
+
+		log.WithError(werr).WithField("attempt", attempt).Warn("reconnect attempt failed")
+
+		// Record that we're still trying so the on-disk state isn't
+		// silently stale for the whole outage, without ever
+		// downgrading an already-persisted exit code back to
+		// "not exited" out from under whoever is relying on it.
+		w.persistIfNotExited()
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	if s, ok := loadProcessState(w.stateDir, w.container, w.execID); ok && s.Exited {
+		log.WithField("exitcode", s.ExitCode).Warn("giving up on agent reconnect, reporting last known exit code")
+		return s.ExitCode, nil
+	}
+
+	return 0, err
+}
+
+// reconnectAndWait redials the agent and re-issues WaitProcess for our
+// container/exec-id. WaitProcess returns as soon as the agent knows the
+// process has exited (immediately, if that already happened while we
+// were disconnected), so a single call both recovers a missed exit code
+// and resumes waiting on a still-running process.
+func (w *reconnectingWaiter) reconnectAndWait(ctx context.Context) (int32, error) {
+	agent, err := aClient.NewAgentClient(ctx, w.agentAddr, false)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := agent.AgentServiceClient.WaitProcess(ctx, &pb.WaitProcessRequest{
+		ContainerId: w.container,
+		ExecId:      w.execID,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.Status, nil
+}
+
+func (w *reconnectingWaiter) persist(exitCode int32, exited bool) {
+	if serr := saveProcessState(w.stateDir, processState{
+		Container: w.container,
+		ExecID:    w.execID,
+		Pid:       uint32(os.Getpid()),
+		ExitCode:  exitCode,
+		Exited:    exited,
+		ExitedAt:  time.Now(),
+	}); serr != nil {
+		logger().WithError(serr).Warn("failed to persist process state")
+	}
+}
+
+// persistIfNotExited refreshes the on-disk record with "still not
+// exited, last seen at now" unless it already holds a real exit code,
+// so a long outage leaves a live, non-stale file behind without ever
+// overwriting a good exit code a previous run already learned and
+// persisted.
+func (w *reconnectingWaiter) persistIfNotExited() {
+	if s, ok := loadProcessState(w.stateDir, w.container, w.execID); ok && s.Exited {
+		return
+	}
+	w.persist(0, false)
+}
+
+// isConnectionError reports whether err looks like a dead/broken gRPC
+// connection to the agent, as opposed to a legitimate failure from the
+// agent itself, which should still be a hard error.
+func isConnectionError(err error) bool {
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package shimv2
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	aClient "github.com/kata-containers/agent/pkg/client"
+	pb "github.com/kata-containers/agent/protocols/grpc"
+	context "golang.org/x/net/context"
+)
+
+// agentClient is a thin, connection-sharing facade over the kata-agent
+// gRPC client. The one-shot proxy mode dials a fresh connection per
+// kata-shim process; here every container and exec process in the
+// sandbox shares the same connection, since the v2 service itself is the
+// one long-lived process per sandbox.
+type agentClient struct {
+	mu     sync.Mutex
+	client *aClient.AgentClient
+}
+
+var (
+	clientsMu sync.Mutex
+	clients   = map[string]*agentClient{}
+)
+
+// newAgentClient returns the shared agent connection for agentAddr,
+// dialing it on first use.
+func newAgentClient(ctx context.Context, agentAddr string) (*agentClient, error) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	if c, ok := clients[agentAddr]; ok {
+		return c, nil
+	}
+
+	client, err := aClient.NewAgentClient(ctx, agentAddr, false)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &agentClient{client: client}
+	clients[agentAddr] = c
+	return c, nil
+}
+
+// createProcess creates either a container's init process (execID == "",
+// via CreateContainer) or an additional exec process in an already
+// running container (via ExecProcess), following the OCI bundle's
+// config.json for the init process' command/args/env the same way the
+// one-shot proxy mode's caller does.
+func (a *agentClient) createProcess(ctx context.Context, container, execID, bundle string, terminal bool, stdin, stdout, stderr string) error {
+	if execID == "" {
+		return a.createContainer(ctx, container, bundle, terminal)
+	}
+	return a.execProcess(ctx, container, execID, terminal)
+}
+
+func (a *agentClient) createContainer(ctx context.Context, container, bundle string, terminal bool) error {
+	spec, err := loadBundleSpec(bundle)
+	if err != nil {
+		return err
+	}
+
+	oci := ociSpecToGRPC(spec)
+	oci.Process.Terminal = terminal
+
+	_, err = a.client.AgentServiceClient.CreateContainer(ctx, &pb.CreateContainerRequest{
+		ContainerId: container,
+		ExecId:      container,
+		OCI:         oci,
+	})
+	return err
+}
+
+func (a *agentClient) execProcess(ctx context.Context, container, execID string, terminal bool) error {
+	_, err := a.client.AgentServiceClient.ExecProcess(ctx, &pb.ExecProcessRequest{
+		ContainerId: container,
+		ExecId:      execID,
+		Process: &pb.Process{
+			Terminal: terminal,
+		},
+	})
+	return err
+}
+
+func (a *agentClient) startProcess(ctx context.Context, container, execID string) error {
+	if execID == "" || execID == container {
+		_, err := a.client.AgentServiceClient.StartContainer(ctx, &pb.StartContainerRequest{
+			ContainerId: container,
+		})
+		return err
+	}
+	// Additional exec processes are started as part of ExecProcess
+	// itself; nothing further is required here.
+	return nil
+}
+
+func (a *agentClient) pid(container, execID string) uint32 {
+	// The agent does not hand back a host-visible pid for guest
+	// processes; containerd only uses this for logging/cgroup purposes
+	// outside the sandbox, so 0 is reported like the one-shot proxy mode
+	// does for non-init processes.
+	return 0
+}
+
+func (a *agentClient) waitProcess(ctx context.Context, container, execID string) int32 {
+	resp, err := a.client.AgentServiceClient.WaitProcess(ctx, &pb.WaitProcessRequest{
+		ContainerId: container,
+		ExecId:      execID,
+	})
+	if err != nil {
+		shimLog.WithError(err).WithFields(map[string]interface{}{
+			"container": container,
+			"exec-id":   execID,
+		}).Error("failed to wait for process")
+		return -1
+	}
+	return resp.Status
+}
+
+func (a *agentClient) signalProcess(ctx context.Context, container, execID string, signal uint32, all bool) error {
+	_, err := a.client.AgentServiceClient.SignalProcess(ctx, &pb.SignalProcessRequest{
+		ContainerId: container,
+		ExecId:      execID,
+		Signal:      signal,
+	})
+	return err
+}
+
+func (a *agentClient) resizeProcessPty(ctx context.Context, container, execID string, width, height uint32) error {
+	_, err := a.client.AgentServiceClient.TtyWinResize(ctx, &pb.TtyWinResizeRequest{
+		ContainerId: container,
+		ExecId:      execID,
+		Row:         height,
+		Column:      width,
+	})
+	return err
+}
+
+func (a *agentClient) closeProcessStdin(ctx context.Context, container, execID string) {
+	if _, err := a.client.AgentServiceClient.CloseStdin(ctx, &pb.CloseStdinRequest{
+		ContainerId: container,
+		ExecId:      execID,
+	}); err != nil {
+		shimLog.WithError(err).WithFields(map[string]interface{}{
+			"container": container,
+			"exec-id":   execID,
+		}).Warn("failed to close process stdin")
+	}
+}
+
+// proxyStdio opens the stdin/stdout/stderr FIFOs containerd created for
+// this process (passed to Create/Exec as paths) and pumps bytes between
+// them and the agent's WriteStdin/ReadStdout/ReadStderr RPCs, the same
+// three copy loops the one-shot proxy mode runs against its own
+// os.Stdin/Stdout/Stderr in shim.proxyStdio, just sourced from per-process
+// FIFOs instead of the shim's own inherited fds.
+func (a *agentClient) proxyStdio(container, execID, stdinPath, stdoutPath, stderrPath string, terminal bool) {
+	log := shimLog.WithFields(map[string]interface{}{
+		"container": container,
+		"exec-id":   execID,
+	})
+
+	if stdinPath != "" {
+		go func() {
+			f, err := os.OpenFile(stdinPath, os.O_RDONLY, 0)
+			if err != nil {
+				log.WithError(err).Error("failed to open stdin fifo")
+				return
+			}
+			defer f.Close()
+			a.copyToAgentStdin(container, execID, f)
+		}()
+	}
+
+	if stdoutPath != "" {
+		go func() {
+			f, err := os.OpenFile(stdoutPath, os.O_WRONLY, 0)
+			if err != nil {
+				log.WithError(err).Error("failed to open stdout fifo")
+				return
+			}
+			defer f.Close()
+			a.copyFromAgentStream(container, execID, f, false)
+		}()
+	}
+
+	if !terminal && stderrPath != "" {
+		go func() {
+			f, err := os.OpenFile(stderrPath, os.O_WRONLY, 0)
+			if err != nil {
+				log.WithError(err).Error("failed to open stderr fifo")
+				return
+			}
+			defer f.Close()
+			a.copyFromAgentStream(container, execID, f, true)
+		}()
+	}
+}
+
+// copyToAgentStdin reads from r until EOF, forwarding every chunk to the
+// agent's WriteStdin RPC.
+func (a *agentClient) copyToAgentStdin(container, execID string, r io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := a.client.AgentServiceClient.WriteStdin(context.Background(), &pb.WriteStreamRequest{
+				ContainerId: container,
+				ExecId:      execID,
+				Data:        buf[:n],
+			}); werr != nil {
+				shimLog.WithError(werr).WithFields(map[string]interface{}{
+					"container": container,
+					"exec-id":   execID,
+				}).Warn("failed to write stdin to agent")
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// copyFromAgentStream polls the agent's ReadStdout/ReadStderr RPC and
+// writes whatever it returns to w, until the process's stdio is closed.
+func (a *agentClient) copyFromAgentStream(container, execID string, w io.Writer, isStderr bool) {
+	for {
+		var (
+			data []byte
+			err  error
+		)
+
+		if isStderr {
+			resp, rerr := a.client.AgentServiceClient.ReadStderr(context.Background(), &pb.ReadStreamRequest{
+				ContainerId: container,
+				ExecId:      execID,
+				Len:         32 * 1024,
+			})
+			err = rerr
+			if resp != nil {
+				data = resp.Data
+			}
+		} else {
+			resp, rerr := a.client.AgentServiceClient.ReadStdout(context.Background(), &pb.ReadStreamRequest{
+				ContainerId: container,
+				ExecId:      execID,
+				Len:         32 * 1024,
+			})
+			err = rerr
+			if resp != nil {
+				data = resp.Data
+			}
+		}
+
+		if len(data) > 0 {
+			if _, werr := w.Write(data); werr != nil {
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+
+		if len(data) == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
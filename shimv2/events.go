@@ -0,0 +1,54 @@
+// Copyright 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package shimv2
+
+import (
+	"time"
+
+	"github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/runtime"
+	"github.com/gogo/protobuf/proto"
+	context "golang.org/x/net/context"
+)
+
+// remoteEventsPublisher forwards task lifecycle events to containerd over
+// the "-publish-binary" helper, the same mechanism containerd's own
+// runtime v2 shims use to avoid keeping a long-lived connection back to
+// containerd open from inside the shim.
+type remoteEventsPublisher struct {
+	namespace     string
+	publishBinary string
+}
+
+func newEventsPublisher(namespace, publishBinary string) *remoteEventsPublisher {
+	return &remoteEventsPublisher{
+		namespace:     namespace,
+		publishBinary: publishBinary,
+	}
+}
+
+func (p *remoteEventsPublisher) publishStart(ctx context.Context, container, execID string, pid uint32) {
+	p.publish(ctx, runtime.TaskStartEventTopic, &events.TaskStart{
+		ContainerID: container,
+		Pid:         pid,
+	})
+}
+
+func (p *remoteEventsPublisher) publishExit(ctx context.Context, container, execID string, pid uint32, status int32, exitedAt time.Time) {
+	p.publish(ctx, runtime.TaskExitEventTopic, &events.TaskExit{
+		ContainerID: container,
+		ID:          execID,
+		Pid:         pid,
+		ExitStatus:  uint32(status),
+		ExitedAt:    exitedAt,
+	})
+}
+
+func (p *remoteEventsPublisher) publish(ctx context.Context, topic string, event proto.Message) {
+	if err := publishEvent(ctx, p.publishBinary, p.namespace, topic, event); err != nil {
+		shimLog.WithError(err).WithField("topic", topic).Error("failed to publish event")
+	}
+}
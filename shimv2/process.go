@@ -0,0 +1,108 @@
+// Copyright 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package shimv2
+
+import (
+	"sync"
+	"time"
+
+	context "golang.org/x/net/context"
+)
+
+// execProcess wraps a single container or exec process multiplexed over
+// the sandbox's shared agent connection. It mirrors the stdio/signal/wait
+// handling the one-shot proxy mode builds around a per-process kata-shim,
+// minus the parts that only make sense for an external, per-exec process
+// (terminal restore on the shim's own stdin, signal forwarding from the
+// shim's controlling terminal, and so on).
+type execProcess struct {
+	container string
+	execID    string
+	terminal  bool
+
+	stdin  string
+	stdout string
+	stderr string
+
+	agent *agentClient
+
+	once     sync.Once
+	exitCode int32
+	exitedAt time.Time
+	exitCh   chan struct{}
+}
+
+// newExecProcess creates a process against the agent: the container's
+// init process when execID is "" (bundle must point at the container's
+// OCI bundle so its config.json can be loaded), or an additional exec
+// process in an already-running container otherwise. stdin/stdout/stderr
+// are the host FIFO paths containerd created for this process's stdio.
+func newExecProcess(ctx context.Context, agentAddr, container, execID, bundle string, terminal bool, stdin, stdout, stderr string) (*execProcess, error) {
+	agent, err := newAgentClient(ctx, agentAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &execProcess{
+		container: container,
+		execID:    execID,
+		terminal:  terminal,
+		stdin:     stdin,
+		stdout:    stdout,
+		stderr:    stderr,
+		agent:     agent,
+		exitCh:    make(chan struct{}),
+	}
+
+	if err := agent.createProcess(ctx, container, execID, bundle, terminal, stdin, stdout, stderr); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *execProcess) pid() uint32 {
+	return p.agent.pid(p.container, p.execID)
+}
+
+func (p *execProcess) start(ctx context.Context) error {
+	if err := p.agent.startProcess(ctx, p.container, p.execID); err != nil {
+		return err
+	}
+
+	p.agent.proxyStdio(p.container, p.execID, p.stdin, p.stdout, p.stderr, p.terminal)
+
+	go func() {
+		code := p.agent.waitProcess(context.Background(), p.container, p.execID)
+		p.once.Do(func() {
+			p.exitCode = code
+			p.exitedAt = time.Now()
+			close(p.exitCh)
+		})
+	}()
+
+	return nil
+}
+
+func (p *execProcess) waitForExit(ctx context.Context) (int32, time.Time) {
+	select {
+	case <-p.exitCh:
+	case <-ctx.Done():
+	}
+	return p.exitCode, p.exitedAt
+}
+
+func (p *execProcess) kill(ctx context.Context, signal uint32, all bool) error {
+	return p.agent.signalProcess(ctx, p.container, p.execID, signal, all)
+}
+
+func (p *execProcess) resizePty(ctx context.Context, width, height uint32) error {
+	return p.agent.resizeProcessPty(ctx, p.container, p.execID, width, height)
+}
+
+func (p *execProcess) closeStdin(ctx context.Context) {
+	p.agent.closeProcessStdin(ctx, p.container, p.execID)
+}
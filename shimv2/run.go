@@ -0,0 +1,171 @@
+// Copyright 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package shimv2
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/runtime/v2/task"
+	"github.com/containerd/ttrpc"
+	"github.com/gogo/protobuf/proto"
+	context "golang.org/x/net/context"
+)
+
+// Config carries the flags shimV2Main parses out of the standard
+// containerd-shim-v2 command line (-namespace, -address,
+// -publish-binary) plus the bundle path and agent socket the sandbox was
+// created with.
+type Config struct {
+	ID            string
+	Bundle        string
+	Namespace     string
+	Address       string
+	PublishBinary string
+	AgentAddr     string
+}
+
+// daemonizedEnv is set in the re-exec'd child's environment so Start can
+// tell it apart from the short-lived "start" invocation containerd made.
+const daemonizedEnv = "KATA_SHIM_V2_DAEMONIZED"
+
+// Start brings up a v2 task service for the sandbox described by cfg.
+// containerd expects a "start" invocation to print the task service's
+// socket address on stdout and exit immediately, while the service
+// itself keeps running for the lifetime of the sandbox. We get both by
+// re-exec'ing ourselves detached from the parent's session the first
+// time through; the detached child serves the socket and only returns
+// from here on a fatal serve error, while the original, short-lived process just relays the
+// child's socket address back to containerd.
+func Start(ctx context.Context, cfg Config) (string, error) {
+	if os.Getenv(daemonizedEnv) != "1" {
+		return daemonize(cfg)
+	}
+	return serve(ctx, cfg)
+}
+
+// daemonize re-execs the current binary with the same arguments in a new
+// session, detached from the parent's controlling terminal and stdio,
+// and reads the socket address the detached child prints on a pipe
+// before returning it to the caller.
+func daemonize(cfg Config) (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exePath, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonizedEnv+"=1")
+	cmd.Stdout = w
+	cmd.Stderr = nil
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return "", err
+	}
+	w.Close()
+
+	// The child now owns its own lifetime; we only needed it long enough
+	// to hand its socket address back to us.
+	if err := cmd.Process.Release(); err != nil {
+		return "", err
+	}
+
+	address, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(address), nil
+}
+
+// serve runs inside the detached child: it creates the task service's
+// socket, prints the address on stdout (piped back to daemonize above),
+// and then blocks serving the TTRPC server for the sandbox's lifetime.
+// It only returns on a fatal serve error.
+func serve(ctx context.Context, cfg Config) (string, error) {
+	address, listener, err := newSocket(cfg.ID)
+	if err != nil {
+		return "", err
+	}
+
+	svc := &service{
+		id:         cfg.ID,
+		bundle:     cfg.Bundle,
+		agentAddr:  cfg.AgentAddr,
+		containers: make(map[string]*container),
+		publisher:  newEventsPublisher(cfg.Namespace, cfg.PublishBinary),
+	}
+
+	server, err := ttrpc.NewServer()
+	if err != nil {
+		listener.Close()
+		return "", err
+	}
+	task.RegisterTaskService(server, svc)
+
+	fmt.Println(address)
+
+	if err := server.Serve(ctx, listener); err != nil {
+		shimLog.WithError(err).Error("ttrpc server exited")
+		return "", err
+	}
+
+	return address, nil
+}
+
+// Delete removes the sandbox's task service socket for a "kata-shim
+// delete" invocation before containerd removes the bundle; no other
+// sandbox-level state is removed.
+func Delete(ctx context.Context, id string) error {
+	return os.RemoveAll(socketPath(id))
+}
+
+func socketPath(id string) string {
+	return filepath.Join(os.TempDir(), "kata-shim", id+".sock")
+}
+
+func newSocket(id string) (string, net.Listener, error) {
+	path := socketPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", nil, err
+	}
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("unix://%s", path), l, nil
+}
+
+// publishEvent shells out to the "-publish-binary" helper containerd
+// handed us, the same out-of-process event delivery every runtime v2
+// shim uses so the shim never needs a live connection back to
+// containerd's event exchange.
+func publishEvent(ctx context.Context, publishBinary, namespace, topic string, event proto.Message) error {
+	data, err := proto.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, publishBinary, "publish", "--namespace", namespace, "--topic", topic)
+	cmd.Stdin = bytes.NewReader(data)
+	return cmd.Run()
+}
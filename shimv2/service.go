@@ -0,0 +1,252 @@
+// Copyright 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// Package shimv2 implements the containerd-shim-v2 TTRPC API on top of the
+// existing kata-shim agent plumbing. Where the one-shot proxy mode in
+// main.go spawns a fresh kata-shim process per exec'd process, the v2
+// service keeps a single long-lived process alive for an entire sandbox and
+// multiplexes every Create/Start/Exec/Kill/Wait/ResizePty/CloseIO/Delete
+// call from containerd onto the same agent gRPC connection.
+package shimv2
+
+import (
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/runtime/v2/task"
+	"github.com/gogo/protobuf/types"
+	"github.com/sirupsen/logrus"
+	context "golang.org/x/net/context"
+)
+
+var shimLog = logrus.WithFields(logrus.Fields{
+	"name":   "kata-shim",
+	"source": "shimv2",
+})
+
+// service is the task.TaskService implementation handed to the ttrpc
+// server. One service instance is created per sandbox (per containerd
+// shim process) and tracks every container and exec process running
+// inside that sandbox.
+type service struct {
+	mu sync.Mutex
+
+	id     string
+	bundle string
+
+	agentAddr string
+
+	// containers indexes every container running in this sandbox (its
+	// init process and its exec processes) by container id.
+	containers map[string]*container
+
+	publisher *remoteEventsPublisher
+}
+
+// container bookkeeps the init process plus every additional exec
+// process spawned inside it, keyed by exec id ("" is the init process).
+type container struct {
+	id     string
+	bundle string
+
+	mu    sync.Mutex
+	execs map[string]*execProcess
+}
+
+func newContainer(id, bundle string) *container {
+	return &container{
+		id:     id,
+		bundle: bundle,
+		execs:  make(map[string]*execProcess),
+	}
+}
+
+func (c *container) addExec(execID string, p *execProcess) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.execs[execID] = p
+}
+
+func (c *container) getExec(execID string) (*execProcess, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.execs[execID]
+	if !ok {
+		return nil, errdefs.ToGRPCf(errdefs.ErrNotFound, "process %s not found", execID)
+	}
+	return p, nil
+}
+
+func (c *container) deleteExec(execID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.execs, execID)
+}
+
+func (s *service) getContainer(id string) (*container, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.containers[id]
+	if !ok {
+		return nil, errdefs.ToGRPCf(errdefs.ErrNotFound, "container %s not found", id)
+	}
+	return c, nil
+}
+
+// Create spawns the init process for a new container in this sandbox
+// through newExecProcess; its stdio is pumped by agentClient.proxyStdio
+// once the process is started.
+func (s *service) Create(ctx context.Context, r *task.CreateTaskRequest) (*task.CreateTaskResponse, error) {
+	s.mu.Lock()
+	if _, ok := s.containers[r.ID]; ok {
+		s.mu.Unlock()
+		return nil, errdefs.ToGRPCf(errdefs.ErrAlreadyExists, "container %s already exists", r.ID)
+	}
+	c := newContainer(r.ID, r.Bundle)
+	s.containers[r.ID] = c
+	s.mu.Unlock()
+
+	proc, err := newExecProcess(ctx, s.agentAddr, r.ID, "", r.Bundle, r.Terminal, r.Stdin, r.Stdout, r.Stderr)
+	if err != nil {
+		s.mu.Lock()
+		delete(s.containers, r.ID)
+		s.mu.Unlock()
+		return nil, err
+	}
+	c.addExec("", proc)
+
+	return &task.CreateTaskResponse{Pid: proc.pid()}, nil
+}
+
+// Start starts a previously created process (init or exec) running.
+func (s *service) Start(ctx context.Context, r *task.StartRequest) (*task.StartResponse, error) {
+	c, err := s.getContainer(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	p, err := c.getExec(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.start(ctx); err != nil {
+		return nil, err
+	}
+
+	s.publisher.publishStart(ctx, r.ID, r.ExecID, p.pid())
+
+	return &task.StartResponse{Pid: p.pid()}, nil
+}
+
+// Exec registers a new exec process against an already-running
+// container, dispatched to the agent as a fresh ExecProcess call.
+func (s *service) Exec(ctx context.Context, r *task.ExecProcessRequest) (*types.Empty, error) {
+	c, err := s.getContainer(r.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	proc, err := newExecProcess(ctx, s.agentAddr, r.ID, r.ExecID, c.bundle, r.Terminal, r.Stdin, r.Stdout, r.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	c.addExec(r.ExecID, proc)
+
+	return empty, nil
+}
+
+// Kill sends a signal to a running process.
+func (s *service) Kill(ctx context.Context, r *task.KillRequest) (*types.Empty, error) {
+	c, err := s.getContainer(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	p, err := c.getExec(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.kill(ctx, r.Signal, r.All); err != nil {
+		return nil, err
+	}
+	return empty, nil
+}
+
+// Wait blocks until the given process has exited and returns its exit
+// status, mirroring shim.wait() in the one-shot proxy mode.
+func (s *service) Wait(ctx context.Context, r *task.WaitRequest) (*task.WaitResponse, error) {
+	c, err := s.getContainer(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	p, err := c.getExec(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+
+	status, exitedAt := p.waitForExit(ctx)
+
+	s.publisher.publishExit(ctx, r.ID, r.ExecID, p.pid(), status, exitedAt)
+
+	return &task.WaitResponse{ExitStatus: uint32(status), ExitedAt: exitedAt}, nil
+}
+
+// ResizePty forwards a pty resize to the agent for the given process.
+func (s *service) ResizePty(ctx context.Context, r *task.ResizePtyRequest) (*types.Empty, error) {
+	c, err := s.getContainer(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	p, err := c.getExec(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.resizePty(ctx, r.Width, r.Height); err != nil {
+		return nil, err
+	}
+	return empty, nil
+}
+
+// CloseIO closes the stdin side of a process once containerd has seen EOF
+// from its client.
+func (s *service) CloseIO(ctx context.Context, r *task.CloseIORequest) (*types.Empty, error) {
+	c, err := s.getContainer(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	p, err := c.getExec(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	p.closeStdin(ctx)
+	return empty, nil
+}
+
+// Delete removes a process from bookkeeping once containerd is done with
+// it, returning its final exit status.
+func (s *service) Delete(ctx context.Context, r *task.DeleteRequest) (*task.DeleteResponse, error) {
+	c, err := s.getContainer(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	p, err := c.getExec(r.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	status, exitedAt := p.waitForExit(ctx)
+	c.deleteExec(r.ExecID)
+
+	if r.ExecID == "" {
+		s.mu.Lock()
+		delete(s.containers, r.ID)
+		s.mu.Unlock()
+	}
+
+	return &task.DeleteResponse{
+		Pid:        p.pid(),
+		ExitStatus: uint32(status),
+		ExitedAt:   exitedAt,
+	}, nil
+}
+
+var empty = &types.Empty{}
@@ -0,0 +1,81 @@
+// Copyright 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package shimv2
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	pb "github.com/kata-containers/agent/protocols/grpc"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// loadBundleSpec reads and parses the OCI runtime spec out of an
+// already-unpacked bundle directory, the same config.json every OCI
+// runtime (including the one-shot kata-shim's caller) is handed.
+func loadBundleSpec(bundle string) (*specs.Spec, error) {
+	data, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var spec specs.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// ociProcessToGRPC translates the subset of an OCI Process the agent
+// cares about into the kata-agent's own Process message.
+func ociProcessToGRPC(p *specs.Process) *pb.Process {
+	if p == nil {
+		return &pb.Process{}
+	}
+
+	env := make([]string, len(p.Env))
+	copy(env, p.Env)
+
+	return &pb.Process{
+		Terminal: p.Terminal,
+		Cwd:      p.Cwd,
+		Env:      env,
+		Args:     append([]string{}, p.Args...),
+	}
+}
+
+// ociSpecToGRPC translates the OCI runtime spec for a container's init
+// process into the kata-agent's own Spec message. CreateContainer needs
+// at minimum the rootfs location and mount table to actually set the
+// container up; without them the agent has nothing to bind-mount and
+// exec into, so this has to carry more than just Process.
+func ociSpecToGRPC(spec *specs.Spec) *pb.Spec {
+	out := &pb.Spec{
+		Version:  spec.Version,
+		Hostname: spec.Hostname,
+		Process:  ociProcessToGRPC(spec.Process),
+	}
+
+	if spec.Root != nil {
+		out.Root = &pb.Root{
+			Path:     spec.Root.Path,
+			Readonly: spec.Root.Readonly,
+		}
+	}
+
+	out.Mounts = make([]*pb.Mount, 0, len(spec.Mounts))
+	for _, m := range spec.Mounts {
+		out.Mounts = append(out.Mounts, &pb.Mount{
+			Destination: m.Destination,
+			Type:        m.Type,
+			Source:      m.Source,
+			Options:     append([]string{}, m.Options...),
+		})
+	}
+
+	return out
+}
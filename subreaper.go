@@ -0,0 +1,311 @@
+// Copyright 2018 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	aClient "github.com/kata-containers/agent/pkg/client"
+	pb "github.com/kata-containers/agent/protocols/grpc"
+	context "golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// execRequest is what a client sends over the -subreaper socket to ask
+// the shim to launch an additional process inside the same container,
+// alongside the one it was originally started for. After this request
+// the connection itself becomes a framed duplex stdio stream for that
+// exec alone (see stdStream/frame/readFrame in attach.go), so concurrent
+// execs hosted by the same shim never share a stdio path.
+type execRequest struct {
+	ExecID   string `json:"exec-id"`
+	Terminal bool   `json:"terminal"`
+}
+
+// subreaperManager turns one kata-shim process into a host for every
+// exec launched against a container, instead of spawning a fresh
+// kata-shim per exec. Running PR_SET_CHILD_SUBREAPER and reaping SIGCHLD
+// lets it also adopt and clean up any orphaned grandchildren that
+// wind up parented to it, matching the containerd osutils.Reap pattern.
+type subreaperManager struct {
+	agentAddr string
+	container string
+
+	agentOnce sync.Once
+	agent     *aClient.AgentClient
+	agentErr  error
+
+	wg sync.WaitGroup
+}
+
+func newSubreaperManager(agentAddr, container string) *subreaperManager {
+	return &subreaperManager{
+		agentAddr: agentAddr,
+		container: container,
+	}
+}
+
+// agentClient returns the one agent connection shared by every exec
+// this manager hosts, dialing it lazily on first use.
+func (m *subreaperManager) agentClient(ctx context.Context) (*aClient.AgentClient, error) {
+	m.agentOnce.Do(func() {
+		m.agent, m.agentErr = aClient.NewAgentClient(ctx, m.agentAddr, false)
+	})
+	return m.agent, m.agentErr
+}
+
+// becomeSubreaper marks the current process as a child subreaper so
+// every exec it spawns (directly or indirectly) gets reparented to it
+// instead of init once its immediate parent exits, and starts the
+// SIGCHLD reaper loop that cleans those orphans up.
+func becomeSubreaper(ctx context.Context) error {
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return err
+	}
+
+	sigc := make(chan os.Signal, 32)
+	signal.Notify(sigc, syscall.SIGCHLD)
+
+	go func() {
+		for {
+			select {
+			case <-sigc:
+				reapChildren()
+			case <-ctx.Done():
+				signal.Stop(sigc)
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// reapChildren drains every exited child we've been reparented to via
+// wait4(-1, ...), the same loop containerd's osutils.Reap runs, so
+// orphaned grandchildren of execs we host don't pile up as zombies.
+func reapChildren() {
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if pid <= 0 || err != nil {
+			return
+		}
+		logger().WithField("pid", pid).Debug("reaped orphaned child")
+	}
+}
+
+// serve listens on the given Unix socket and accepts additional exec
+// requests for as long as ctx is alive, dispatching each to the agent
+// and tracking its stdio/exit over its own accepted connection, not the
+// shim's own os.Stdin/Stdout/Stderr, so concurrent execs don't interleave.
+func (m *subreaperManager) serve(ctx context.Context, socketPath string) error {
+	os.Remove(socketPath)
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return nil
+		}
+
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.handleConn(ctx, conn)
+		}()
+	}
+}
+
+func (m *subreaperManager) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// json.Decoder reads ahead into its own internal buffer, so any
+	// stdio frame a client pipelines immediately after the request
+	// would otherwise be silently buffered inside the decoder and never
+	// reach readFrame below. Frames are read from whatever the decoder
+	// buffered past the request first, then from the connection, so
+	// nothing pipelined early is lost.
+	br := bufio.NewReader(conn)
+
+	var req execRequest
+	dec := json.NewDecoder(br)
+	if err := dec.Decode(&req); err != nil {
+		logger().WithError(err).Error("failed to decode exec request")
+		return
+	}
+	stdio := io.MultiReader(dec.Buffered(), br)
+
+	log := logger().WithField("container", m.container).WithField("exec-id", req.ExecID)
+
+	agent, err := m.agentClient(ctx)
+	if err != nil {
+		log.WithError(err).Error("failed to dial agent")
+		writeExitFrame(conn, -1)
+		return
+	}
+
+	if _, err := agent.AgentServiceClient.ExecProcess(ctx, &pb.ExecProcessRequest{
+		ContainerId: m.container,
+		ExecId:      req.ExecID,
+		Process:     &pb.Process{Terminal: req.Terminal},
+	}); err != nil {
+		log.WithError(err).Error("failed to create exec process")
+		writeExitFrame(conn, -1)
+		return
+	}
+
+	// stdin/stdout/stderr for this exec are framed over conn alone, so
+	// two execs accepted concurrently on this same shim never touch a
+	// shared os.Stdin/os.Stdout/os.Stderr.
+	stdinDone := make(chan struct{})
+	go func() {
+		defer close(stdinDone)
+		pumpExecStdin(agent, m.container, req.ExecID, stdio)
+	}()
+
+	var outWg sync.WaitGroup
+	outWg.Add(1)
+	go func() {
+		defer outWg.Done()
+		pumpExecStdout(agent, m.container, req.ExecID, conn, req.Terminal)
+	}()
+	outWg.Wait()
+
+	resp, err := agent.AgentServiceClient.WaitProcess(ctx, &pb.WaitProcessRequest{
+		ContainerId: m.container,
+		ExecId:      req.ExecID,
+	})
+	exitCode := int32(-1)
+	if err != nil {
+		log.WithError(err).Error("failed waiting for exec process")
+	} else {
+		exitCode = resp.Status
+		log.WithField("exitcode", exitCode).Info("exec process exited")
+	}
+
+	writeExitFrame(conn, exitCode)
+}
+
+// pumpExecStdin reads framed stdin chunks off r (ignoring any other
+// frame types a client might send early) and forwards them to the
+// agent for this one exec, until the client half-closes or disconnects.
+// r must yield the bytes handleConn's request decoder buffered past the
+// request before the rest of the connection, so that any stdio the
+// client pipelined right after the request isn't left stranded in the
+// decoder's read-ahead buffer.
+func pumpExecStdin(agent *aClient.AgentClient, container, execID string, r io.Reader) {
+	for {
+		stream, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		if stream != stdin || len(payload) == 0 {
+			continue
+		}
+		if _, err := agent.AgentServiceClient.WriteStdin(context.Background(), &pb.WriteStreamRequest{
+			ContainerId: container,
+			ExecId:      execID,
+			Data:        payload,
+		}); err != nil {
+			return
+		}
+	}
+}
+
+// pumpExecStdout polls the agent's ReadStdout/ReadStderr RPCs for this
+// exec and writes each chunk back to conn as its own framed message,
+// until the process's stdio is closed out from under it.
+func pumpExecStdout(agent *aClient.AgentClient, container, execID string, conn net.Conn, terminal bool) {
+	streams := []stdStream{stdout}
+	if !terminal {
+		streams = append(streams, stderr)
+	}
+
+	done := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() { stopOnce.Do(func() { close(done) }) }
+
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func(stream stdStream) {
+			defer wg.Done()
+			defer stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				var (
+					data []byte
+					err  error
+				)
+				if stream == stderr {
+					resp, rerr := agent.AgentServiceClient.ReadStderr(context.Background(), &pb.ReadStreamRequest{ContainerId: container, ExecId: execID, Len: 32 * 1024})
+					err = rerr
+					if resp != nil {
+						data = resp.Data
+					}
+				} else {
+					resp, rerr := agent.AgentServiceClient.ReadStdout(context.Background(), &pb.ReadStreamRequest{ContainerId: container, ExecId: execID, Len: 32 * 1024})
+					err = rerr
+					if resp != nil {
+						data = resp.Data
+					}
+				}
+
+				if len(data) > 0 {
+					if _, werr := conn.Write(frame(stream, data)); werr != nil {
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}(s)
+	}
+
+	wg.Wait()
+}
+
+func writeExitFrame(w io.Writer, exitCode int32) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(exitCode))
+	if _, err := w.Write(frame(stdExit, payload)); err != nil {
+		logger().WithError(err).Error("failed to write exec exit frame")
+	}
+}
+
+// wait blocks until every exec this manager has accepted has finished
+// being handled, so the shim process doesn't exit out from under
+// in-flight execs.
+func (m *subreaperManager) wait() {
+	m.wg.Wait()
+}